@@ -0,0 +1,110 @@
+package libkbfs
+
+import (
+	"context"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+)
+
+// EphemeralPeerCiphertext pairs up a single device's encrypted TLF
+// crypt key client half with the ephemeral public key it was
+// encrypted against, so that a whole bundle's worth of candidates can
+// be handed to the crypto service in a single RPC rather than probed
+// one at a time.
+type EphemeralPeerCiphertext struct {
+	PeerPublicKey TLFEphemeralPublicKey
+	Ciphertext    EncryptedTLFCryptKeyClientHalf
+}
+
+// DecryptTLFCryptKeyClientHalfAny tries to decrypt one of the given
+// (ephemeral public key, encrypted client half) pairs using any of
+// the caller's device crypt keys, and returns the index of the pair
+// that was decrypted along with the resulting client half. Unlike
+// DecryptTLFCryptKeyClientHalf, which requires the caller to already
+// know which TLFEphemeralPublicKeys entry its device was granted
+// access through, this lets the caller hand over every candidate from
+// a TLFKeyBundle and have the crypto service pick the one it can
+// unbox, replacing what would otherwise be N round-trips with one.
+func (c *CryptoClient) DecryptTLFCryptKeyClientHalfAny(ctx context.Context,
+	ciphertexts []EphemeralPeerCiphertext) (
+	index int, clientHalf TLFCryptKeyClientHalf, err error) {
+	if len(ciphertexts) == 0 {
+		return 0, TLFCryptKeyClientHalf{}, NoKeysError{}
+	}
+
+	bundles := make([]keybase1.CiphertextBundle, len(ciphertexts))
+	for i, ct := range ciphertexts {
+		bundles[i] = keybase1.CiphertextBundle{
+			Kid:        ct.PeerPublicKey.kid(),
+			Ciphertext: ct.Ciphertext.boxedData(),
+			Nonce:      ct.Ciphertext.nonce(),
+		}
+	}
+
+	res, err := c.client.UnboxBytesAny(ctx, keybase1.UnboxBytesAnyArg{
+		Bundles: bundles,
+		Reason:  "to decrypt a TLF crypt key client half",
+	})
+	if err != nil {
+		return 0, TLFCryptKeyClientHalf{}, err
+	}
+
+	var half TLFCryptKeyClientHalf
+	if err := half.unmarshalPlaintext(res.Plaintext); err != nil {
+		return 0, TLFCryptKeyClientHalf{}, err
+	}
+
+	return res.Index, half, nil
+}
+
+// ClientHalfDecrypter is the subset of Crypto capable of unboxing a
+// TLF crypt key client half for one of the caller's own devices, given
+// every candidate ciphertext from across the key generations that
+// might have granted that device access. Both CryptoClient (a single
+// bundled server-side UnboxBytesAny) and HardwareCrypto (a per-device
+// loop against a hardware transport) implement it, so
+// DecryptTLFCryptKeyClientHalfAny below works the same regardless of
+// where the caller's device key actually lives.
+type ClientHalfDecrypter interface {
+	DecryptTLFCryptKeyClientHalfAny(ctx context.Context,
+		ciphertexts []EphemeralPeerCiphertext) (
+		index int, clientHalf TLFCryptKeyClientHalf, err error)
+}
+
+// DecryptTLFCryptKeyClientHalfAny collects every TLFCryptKeyInfo that
+// bundles has on file for user's deviceKey across however many key
+// generations it spans, pairs each with the TLFEphemeralPublicKey it
+// was encrypted against, and asks decrypter to unbox whichever one it
+// can. This is the real caller-facing decrypt path: a caller generally
+// doesn't know which rekey added its device, so it hands over every
+// generation's candidate rather than probing one at a time.
+func DecryptTLFCryptKeyClientHalfAny(ctx context.Context, decrypter ClientHalfDecrypter,
+	bundles []TLFKeyBundle, user keybase1.UID, deviceKey CryptPublicKey) (
+	TLFCryptKeyClientHalf, error) {
+	var ciphertexts []EphemeralPeerCiphertext
+	for _, b := range bundles {
+		info, ok, err := b.GetTLFCryptKeyInfo(user, deviceKey)
+		if err != nil {
+			return TLFCryptKeyClientHalf{}, err
+		}
+		if !ok {
+			continue
+		}
+
+		ePubKey, err := b.GetTLFEphemeralPublicKey(user, deviceKey)
+		if err != nil {
+			return TLFCryptKeyClientHalf{}, err
+		}
+
+		ciphertexts = append(ciphertexts, EphemeralPeerCiphertext{
+			PeerPublicKey: ePubKey,
+			Ciphertext:    info.ClientHalf,
+		})
+	}
+	if len(ciphertexts) == 0 {
+		return TLFCryptKeyClientHalf{}, NoKeysError{}
+	}
+
+	_, clientHalf, err := decrypter.DecryptTLFCryptKeyClientHalfAny(ctx, ciphertexts)
+	return clientHalf, err
+}
@@ -0,0 +1,62 @@
+package libkbfs
+
+import (
+	"context"
+	"testing"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+)
+
+// fakeClientHalfDecrypter always unboxes the ciphertext at wantIndex,
+// recording the full candidate list it was handed so tests can assert
+// on what DecryptTLFCryptKeyClientHalfAny collected.
+type fakeClientHalfDecrypter struct {
+	wantIndex int
+	got       []EphemeralPeerCiphertext
+}
+
+func (d *fakeClientHalfDecrypter) DecryptTLFCryptKeyClientHalfAny(ctx context.Context,
+	ciphertexts []EphemeralPeerCiphertext) (int, TLFCryptKeyClientHalf, error) {
+	d.got = ciphertexts
+	return d.wantIndex, TLFCryptKeyClientHalf{}, nil
+}
+
+func TestDecryptTLFCryptKeyClientHalfAnyCollectsAllGenerations(t *testing.T) {
+	user := keybase1.UID("alice")
+	device := CryptPublicKey{KID: keybase1.KID("alice-device")}
+
+	makeBundle := func(ePubIndex int) TLFKeyBundle {
+		b := NewTLFKeyBundle()
+		b.TLFEphemeralPublicKeys = append(b.TLFEphemeralPublicKeys, TLFEphemeralPublicKey{})
+		b.WKeys[user] = UserCryptKeyBundle{
+			device.KID: TLFCryptKeyInfo{EPubKeyIndex: ePubIndex},
+		}
+		return *b
+	}
+
+	bundles := []TLFKeyBundle{makeBundle(0), makeBundle(0)}
+	decrypter := &fakeClientHalfDecrypter{wantIndex: 1}
+
+	_, err := DecryptTLFCryptKeyClientHalfAny(
+		context.Background(), decrypter, bundles, user, device)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(decrypter.got) != len(bundles) {
+		t.Fatalf("got %d candidate ciphertexts, want %d", len(decrypter.got), len(bundles))
+	}
+}
+
+func TestDecryptTLFCryptKeyClientHalfAnyNoCandidates(t *testing.T) {
+	user := keybase1.UID("alice")
+	device := CryptPublicKey{KID: keybase1.KID("alice-device")}
+
+	bundles := []TLFKeyBundle{*NewTLFKeyBundle()}
+	decrypter := &fakeClientHalfDecrypter{}
+
+	_, err := DecryptTLFCryptKeyClientHalfAny(
+		context.Background(), decrypter, bundles, user, device)
+	if _, ok := err.(NoKeysError); !ok {
+		t.Fatalf("got error %v, want NoKeysError", err)
+	}
+}
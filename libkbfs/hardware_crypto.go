@@ -0,0 +1,191 @@
+package libkbfs
+
+import (
+	"context"
+	"time"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+)
+
+// DeviceKeyKind distinguishes where a device's private key material
+// actually lives. It is recorded per-device on TLFCryptKeyInfo.DeviceKind
+// so callers that need to reason about sync vs. prompt-and-wait
+// behavior (e.g. rekey UI) don't have to guess from the key type
+// alone.
+type DeviceKeyKind int
+
+const (
+	// DeviceKeyKindLocal is an ordinary device key held in the local
+	// keyring.
+	DeviceKeyKindLocal DeviceKeyKind = iota
+	// DeviceKeyKindPaper is a paper backup key.
+	DeviceKeyKindPaper
+	// DeviceKeyKindHardware is a key whose private half never leaves
+	// an external hardware device (e.g. a Ledger-style secp256k1/ed25519
+	// wallet); only its public point is available locally.
+	DeviceKeyKindHardware
+)
+
+// hardwareRPCTimeout is how long HardwareCrypto waits for a user to
+// confirm an operation on the physical device before giving up,
+// mirroring the generous timeouts RPCs to other long-running user
+// prompts use.
+const hardwareRPCTimeout = 5 * time.Minute
+
+// hardwareLogInterval is how often logAboutLongRPCUnlessCancelled
+// reminds the user it's still waiting on a physical device
+// confirmation, so silence during a multi-minute wait doesn't read as
+// a hang. It's a var rather than a const so tests can shrink it rather
+// than waiting out the real interval.
+var hardwareLogInterval = 10 * time.Second
+
+// Logger is the minimal logging capability HardwareCrypto needs; it's
+// satisfied by the logger.Logger implementation used throughout
+// libkbfs.
+type Logger interface {
+	Warning(format string, args ...interface{})
+}
+
+// logAboutLongRPCUnlessCancelled runs op in the background and waits
+// for it to finish, logging a reminder to log every
+// hardwareLogInterval for as long as it's still running. If ctx is
+// cancelled first, it returns ctx.Err() without waiting for op (op may
+// still be running in the background; callers are expected to have
+// derived ctx from a context.WithTimeout/WithCancel they control).
+func logAboutLongRPCUnlessCancelled(ctx context.Context, log Logger,
+	description string, op func() (interface{}, error)) (interface{}, error) {
+	type result struct {
+		val interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		val, err := op()
+		done <- result{val, err}
+	}()
+
+	ticker := time.NewTicker(hardwareLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-done:
+			return r.val, r.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+			if log != nil {
+				log.Warning(
+					"still waiting on %s; confirm the operation on your hardware device",
+					description)
+			}
+		}
+	}
+}
+
+// HardwareTransport is the pluggable transport HardwareCrypto uses to
+// reach the physical device, e.g. over USB HID. Production code talks
+// to a real device; tests substitute mockHardwareTransport.
+type HardwareTransport interface {
+	// Sign asks the device to sign msg with the key identified by kid,
+	// blocking until the user confirms (or rejects) the operation on
+	// the device itself.
+	Sign(ctx context.Context, kid keybase1.KID, msg []byte) ([]byte, error)
+	// Unbox asks the device to decrypt encryptedData, which was
+	// encrypted to the device's public key, blocking on user
+	// confirmation as with Sign.
+	Unbox(ctx context.Context, kid keybase1.KID, encryptedData []byte) ([]byte, error)
+}
+
+// HardwareCrypto routes signing and client-half decryption for
+// hardware-backed devices through a HardwareTransport instead of a
+// local private key. Its Sign and DecryptTLFCryptKeyClientHalf take
+// the device KID explicitly and return raw results, so their
+// signatures differ from Crypto's methods of the same names and
+// HardwareCrypto does not satisfy the Crypto interface. Every operation
+// requires the user to physically confirm it on the device, so calls
+// run with a long timeout and are logged periodically while waiting,
+// via logAboutLongRPCUnlessCancelled.
+type HardwareCrypto struct {
+	CryptoCommon
+	transport HardwareTransport
+	// kid is the KID of the device key this HardwareCrypto speaks for;
+	// it's what every Sign/Unbox call against transport is made on
+	// behalf of.
+	kid keybase1.KID
+	log Logger
+}
+
+// NewHardwareCrypto returns a HardwareCrypto that talks to the device
+// through the given transport on behalf of the device key kid,
+// logging progress reminders for long-running confirmations to log
+// (which may be nil to disable logging, e.g. in tests).
+func NewHardwareCrypto(transport HardwareTransport, kid keybase1.KID, log Logger) *HardwareCrypto {
+	return &HardwareCrypto{transport: transport, kid: kid, log: log}
+}
+
+// Sign asks the hardware device to sign msg with the given device key.
+func (hc *HardwareCrypto) Sign(ctx context.Context, kid keybase1.KID, msg []byte) (
+	sig []byte, err error) {
+	ctx, cancel := context.WithTimeout(ctx, hardwareRPCTimeout)
+	defer cancel()
+
+	val, err := logAboutLongRPCUnlessCancelled(ctx, hc.log,
+		"a hardware device signature", func() (interface{}, error) {
+			return hc.transport.Sign(ctx, kid, msg)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]byte), nil
+}
+
+// DecryptTLFCryptKeyClientHalf asks the hardware device to decrypt a
+// client half that was encrypted to its public key. Unlike the
+// software path, there is no local private key to mask against: the
+// device itself performs the unboxing.
+func (hc *HardwareCrypto) DecryptTLFCryptKeyClientHalf(ctx context.Context,
+	kid keybase1.KID, encryptedClientHalf EncryptedTLFCryptKeyClientHalf) (
+	clientHalf TLFCryptKeyClientHalf, err error) {
+	ctx, cancel := context.WithTimeout(ctx, hardwareRPCTimeout)
+	defer cancel()
+
+	val, err := logAboutLongRPCUnlessCancelled(ctx, hc.log,
+		"a hardware device client-half decryption", func() (interface{}, error) {
+			return hc.transport.Unbox(ctx, kid, encryptedClientHalf.boxedData())
+		})
+	if err != nil {
+		return TLFCryptKeyClientHalf{}, err
+	}
+
+	var half TLFCryptKeyClientHalf
+	if err := half.unmarshalPlaintext(val.([]byte)); err != nil {
+		return TLFCryptKeyClientHalf{}, err
+	}
+	return half, nil
+}
+
+// DecryptTLFCryptKeyClientHalfAny implements ClientHalfDecrypter for
+// HardwareCrypto. It tries every candidate ciphertext against hc.kid
+// in turn, stopping at the first one the device can unbox. Only each
+// ciphertext's boxed data is handed to the transport; its
+// PeerPublicKey and nonce are not passed along. Hardware transports generally can't batch
+// the way CryptoClient's server-side UnboxBytesAny can, so this is the
+// client-side equivalent that still lets callers use HardwareCrypto
+// and CryptoClient polymorphically through the same call.
+func (hc *HardwareCrypto) DecryptTLFCryptKeyClientHalfAny(ctx context.Context,
+	ciphertexts []EphemeralPeerCiphertext) (
+	index int, clientHalf TLFCryptKeyClientHalf, err error) {
+	if len(ciphertexts) == 0 {
+		return 0, TLFCryptKeyClientHalf{}, NoKeysError{}
+	}
+
+	var lastErr error
+	for i, ct := range ciphertexts {
+		half, err := hc.DecryptTLFCryptKeyClientHalf(ctx, hc.kid, ct.Ciphertext)
+		if err == nil {
+			return i, half, nil
+		}
+		lastErr = err
+	}
+	return 0, TLFCryptKeyClientHalf{}, lastErr
+}
@@ -0,0 +1,151 @@
+package libkbfs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+)
+
+// mockHardwareTransport is a fake HardwareTransport for tests,
+// analogous to a Ledger simulator: it never actually talks to a
+// device, but lets tests control per-call delay and failure the same
+// way a physical device's confirmation prompt or a user rejection
+// would show up to HardwareCrypto.
+type mockHardwareTransport struct {
+	delay    time.Duration
+	signErr  error
+	unboxErr error
+	unboxed  []byte
+}
+
+func (t *mockHardwareTransport) Sign(ctx context.Context, kid keybase1.KID, msg []byte) (
+	[]byte, error) {
+	if t.delay > 0 {
+		select {
+		case <-time.After(t.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if t.signErr != nil {
+		return nil, t.signErr
+	}
+	return msg, nil
+}
+
+func (t *mockHardwareTransport) Unbox(ctx context.Context, kid keybase1.KID,
+	encryptedData []byte) ([]byte, error) {
+	if t.delay > 0 {
+		select {
+		case <-time.After(t.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if t.unboxErr != nil {
+		return nil, t.unboxErr
+	}
+	return t.unboxed, nil
+}
+
+type mockHardwareLogger struct {
+	warnings int
+}
+
+func (l *mockHardwareLogger) Warning(format string, args ...interface{}) {
+	l.warnings++
+}
+
+func TestHardwareCryptoSign(t *testing.T) {
+	transport := &mockHardwareTransport{}
+	hc := NewHardwareCrypto(transport, keybase1.KID("device1"), nil)
+
+	sig, err := hc.Sign(context.Background(), keybase1.KID("device1"), []byte("msg"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(sig) != "msg" {
+		t.Errorf("got sig %q, want %q", sig, "msg")
+	}
+}
+
+func TestHardwareCryptoSignError(t *testing.T) {
+	wantErr := errors.New("user rejected on device")
+	transport := &mockHardwareTransport{signErr: wantErr}
+	hc := NewHardwareCrypto(transport, keybase1.KID("device1"), nil)
+
+	_, err := hc.Sign(context.Background(), keybase1.KID("device1"), []byte("msg"))
+	if err != wantErr {
+		t.Fatalf("got error %v, want %v", err, wantErr)
+	}
+}
+
+func TestHardwareCryptoLogsWhileWaiting(t *testing.T) {
+	origInterval := hardwareLogIntervalForTest()
+	defer origInterval()
+
+	transport := &mockHardwareTransport{delay: 35 * time.Millisecond}
+	log := &mockHardwareLogger{}
+	hc := NewHardwareCrypto(transport, keybase1.KID("device1"), log)
+
+	_, err := hc.Sign(context.Background(), keybase1.KID("device1"), []byte("msg"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if log.warnings == 0 {
+		t.Errorf("expected at least one progress warning while waiting on the device")
+	}
+}
+
+func TestHardwareCryptoRespectsCancellation(t *testing.T) {
+	transport := &mockHardwareTransport{delay: time.Hour}
+	hc := NewHardwareCrypto(transport, keybase1.KID("device1"), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := hc.Sign(ctx, keybase1.KID("device1"), []byte("msg"))
+	if err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestHardwareCryptoDecryptTLFCryptKeyClientHalfAny(t *testing.T) {
+	transport := &mockHardwareTransport{unboxed: make([]byte, 32)}
+	hc := NewHardwareCrypto(transport, keybase1.KID("device1"), nil)
+
+	ciphertexts := []EphemeralPeerCiphertext{
+		{},
+		{},
+	}
+	index, _, err := hc.DecryptTLFCryptKeyClientHalfAny(context.Background(), ciphertexts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if index != 0 {
+		t.Errorf("got index %d, want 0", index)
+	}
+}
+
+func TestHardwareCryptoDecryptTLFCryptKeyClientHalfAnyNoCandidates(t *testing.T) {
+	transport := &mockHardwareTransport{}
+	hc := NewHardwareCrypto(transport, keybase1.KID("device1"), nil)
+
+	_, _, err := hc.DecryptTLFCryptKeyClientHalfAny(context.Background(), nil)
+	if _, ok := err.(NoKeysError); !ok {
+		t.Fatalf("got error %v, want NoKeysError", err)
+	}
+}
+
+// hardwareLogIntervalForTest shrinks hardwareLogInterval for the
+// duration of a test so tests observing the periodic-logging behavior
+// don't have to wait out the real 10-second production interval; it
+// returns a func that restores the original value.
+func hardwareLogIntervalForTest() func() {
+	orig := hardwareLogInterval
+	hardwareLogInterval = 10 * time.Millisecond
+	return func() { hardwareLogInterval = orig }
+}
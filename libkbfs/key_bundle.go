@@ -1,6 +1,13 @@
 package libkbfs
 
-import keybase1 "github.com/keybase/client/go/protocol"
+import (
+	"context"
+	"runtime"
+	"sort"
+	"sync"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+)
 
 // All section references below are to https://keybase.io/blog/kbfs-crypto
 // (version 1.3).
@@ -25,6 +32,14 @@ type TLFCryptKeyInfo struct {
 	ClientHalf   EncryptedTLFCryptKeyClientHalf
 	ServerHalfID TLFCryptKeyServerHalfID
 	EPubKeyIndex int `codec:"i,omitempty"`
+
+	// DeviceKind records where this device's private key material
+	// lives, so a caller deciding whether to expect an instant local
+	// unwrap or a long hardware-confirmation round trip doesn't have
+	// to guess from the key type alone. It defaults to
+	// DeviceKeyKindLocal for devices filled in before this field
+	// existed.
+	DeviceKind DeviceKeyKind `codec:"deviceKind,omitempty"`
 }
 
 // DeepCopy returns a complete copy of a TLFCryptKeyInfo.
@@ -33,6 +48,7 @@ func (info TLFCryptKeyInfo) DeepCopy() TLFCryptKeyInfo {
 		ClientHalf:   info.ClientHalf.DeepCopy(),
 		ServerHalfID: info.ServerHalfID.DeepCopy(),
 		EPubKeyIndex: info.EPubKeyIndex,
+		DeviceKind:   info.DeviceKind,
 	}
 }
 
@@ -50,56 +66,138 @@ func (uckb UserCryptKeyBundle) DeepCopy() UserCryptKeyBundle {
 	return newUckb
 }
 
-func (uckb UserCryptKeyBundle) fillInDeviceInfo(crypto Crypto,
+// defaultKeyHalfWorkers is the default size of the worker pool that
+// fillInDeviceInfo uses to parallelize per-device key-half generation,
+// used whenever a caller passes numWorkers <= 0. It defaults to
+// GOMAXPROCS so a TLF with hundreds of writer+reader devices doesn't
+// pay a purely serial latency cost during rekey, while still capping
+// the number of goroutines spawned at once.
+var defaultKeyHalfWorkers = runtime.GOMAXPROCS(0)
+
+func (uckb UserCryptKeyBundle) fillInDeviceInfo(ctx context.Context, crypto Crypto,
 	uid keybase1.UID, tlfCryptKey TLFCryptKey,
 	ePrivKey TLFEphemeralPrivateKey, ePubIndex int,
-	publicKeys []CryptPublicKey) (
+	publicKeys []CryptPublicKey, kinds map[keybase1.KID]DeviceKeyKind,
+	numWorkers int) (
 	serverMap map[keybase1.KID]TLFCryptKeyServerHalf, err error) {
 	serverMap = make(map[keybase1.KID]TLFCryptKeyServerHalf)
-	// for each device:
-	//    * create a new random server half
-	//    * mask it with the key to get the client half
-	//    * encrypt the client half
-	//
-	// TODO: parallelize
+
+	// Only devices that don't already have an entry need new key
+	// halves; keep track of their original position so the results
+	// can be applied back in a deterministic order regardless of
+	// which worker finishes first.
+	var newKeys []CryptPublicKey
 	for _, k := range publicKeys {
-		// Skip existing entries, only fill in new ones
 		if _, ok := uckb[k.KID]; ok {
 			continue
 		}
+		newKeys = append(newKeys, k)
+	}
+	if len(newKeys) == 0 {
+		return serverMap, nil
+	}
 
-		var serverHalf TLFCryptKeyServerHalf
-		serverHalf, err = crypto.MakeRandomTLFCryptKeyServerHalf()
-		if err != nil {
-			return nil, err
-		}
+	parentCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		var clientHalf TLFCryptKeyClientHalf
-		clientHalf, err = crypto.MaskTLFCryptKey(serverHalf, tlfCryptKey)
-		if err != nil {
-			return nil, err
-		}
+	infos := make([]TLFCryptKeyInfo, len(newKeys))
+	halves := make([]TLFCryptKeyServerHalf, len(newKeys))
+	errs := make([]error, len(newKeys))
 
-		var encryptedClientHalf EncryptedTLFCryptKeyClientHalf
-		encryptedClientHalf, err =
-			crypto.EncryptTLFCryptKeyClientHalf(ePrivKey, k, clientHalf)
-		if err != nil {
-			return nil, err
-		}
+	if numWorkers <= 0 {
+		numWorkers = defaultKeyHalfWorkers
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	if numWorkers > len(newKeys) {
+		numWorkers = len(newKeys)
+	}
 
-		var serverHalfID TLFCryptKeyServerHalfID
-		serverHalfID, err =
-			crypto.GetTLFCryptKeyServerHalfID(uid, k.KID, serverHalf)
-		if err != nil {
-			return nil, err
+	// For each device, in parallel across a bounded worker pool:
+	//    * create a new random server half
+	//    * mask it with the key to get the client half
+	//    * encrypt the client half
+	//
+	// This only ever touches the device's public crypt key, so it
+	// works the same whether the device's private half lives in a
+	// local keyring or on external hardware (see HardwareCrypto).
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, numWorkers)
+	for i, k := range newKeys {
+		select {
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		case sem <- struct{}{}:
 		}
 
-		uckb[k.KID] = TLFCryptKeyInfo{
-			ClientHalf:   encryptedClientHalf,
-			ServerHalfID: serverHalfID,
-			EPubKeyIndex: ePubIndex,
+		wg.Add(1)
+		go func(i int, k CryptPublicKey) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// A failure only stops later devices from being dispatched;
+			// a device already dispatched still runs unless the caller's
+			// own ctx is cancelled, so its real error isn't masked.
+			if parentCtx.Err() != nil {
+				errs[i] = parentCtx.Err()
+				return
+			}
+
+			serverHalf, err := crypto.MakeRandomTLFCryptKeyServerHalf()
+			if err != nil {
+				errs[i] = err
+				cancel()
+				return
+			}
+
+			clientHalf, err := crypto.MaskTLFCryptKey(serverHalf, tlfCryptKey)
+			if err != nil {
+				errs[i] = err
+				cancel()
+				return
+			}
+
+			encryptedClientHalf, err :=
+				crypto.EncryptTLFCryptKeyClientHalf(ePrivKey, k, clientHalf)
+			if err != nil {
+				errs[i] = err
+				cancel()
+				return
+			}
+
+			serverHalfID, err :=
+				crypto.GetTLFCryptKeyServerHalfID(uid, k.KID, serverHalf)
+			if err != nil {
+				errs[i] = err
+				cancel()
+				return
+			}
+
+			infos[i] = TLFCryptKeyInfo{
+				ClientHalf:   encryptedClientHalf,
+				ServerHalfID: serverHalfID,
+				EPubKeyIndex: ePubIndex,
+				DeviceKind:   kinds[k.KID],
+			}
+			halves[i] = serverHalf
+		}(i, k)
+	}
+	wg.Wait()
+
+	// Surface the first error in publicKeys order, matching the
+	// first-error semantics of the old serial loop.
+	for _, e := range errs {
+		if e != nil {
+			return nil, e
 		}
-		serverMap[k.KID] = serverHalf
+	}
+
+	for i, k := range newKeys {
+		uckb[k.KID] = infos[i]
+		serverMap[k.KID] = halves[i]
 	}
 
 	return serverMap, nil
@@ -130,14 +228,53 @@ func (tkg TLFWriterKeyGenerations) GetKeyGeneration() KeyGen {
 	return KeyGen(len(tkg))
 }
 
-// IsWriter returns whether or not the user+device is an authorized writer
-// for the latest generation.
-func (tkg TLFWriterKeyGenerations) IsWriter(user keybase1.UID, deviceKID keybase1.KID) bool {
+// IsWriter returns whether or not the user+device is an authorized
+// writer for the latest generation. It fails closed: if the latest
+// generation's WriterMetadataSig doesn't verify against
+// writerVerifyingKey, the bundle can't be trusted (a bserver may have
+// tampered with WKeys), so IsWriter returns false regardless of what
+// WKeys itself says.
+func (tkg TLFWriterKeyGenerations) IsWriter(crypto Crypto, writerVerifyingKey VerifyingKey,
+	user keybase1.UID, deviceKID keybase1.KID) bool {
 	keyGen := tkg.GetKeyGeneration()
 	if keyGen < 1 {
 		return false
 	}
-	return tkg[keyGen-1].IsWriter(user, deviceKID)
+	latest := tkg[keyGen-1]
+	if err := latest.Verify(crypto, writerVerifyingKey); err != nil {
+		return false
+	}
+	return latest.IsWriter(user, deviceKID)
+}
+
+// NotATLFWriterError is returned when a user/device that isn't a
+// writer at the latest key generation tries to append a new one, e.g.
+// via TLFWriterKeyGenerations.Append.
+type NotATLFWriterError struct {
+	User   keybase1.UID
+	Device keybase1.KID
+}
+
+func (e NotATLFWriterError) Error() string {
+	return "user " + e.User.String() + " device " + e.Device.String() +
+		" is not a writer at the latest key generation"
+}
+
+// Append adds newBundle as the next key generation on behalf of
+// caller/callerDevice, returning the extended generations slice. It
+// rejects the append with a NotATLFWriterError if there is already at
+// least one generation and the caller isn't a verified writer at the
+// latest one, since only an existing writer may rotate in a new
+// generation (e.g. to revoke a device). crypto/writerVerifyingKey are
+// used to verify the latest generation's signature before trusting its
+// WKeys for that check; see TLFWriterKeyGenerations.IsWriter.
+func (tkg TLFWriterKeyGenerations) Append(crypto Crypto, writerVerifyingKey VerifyingKey,
+	caller keybase1.UID, callerDevice keybase1.KID, newBundle *TLFWriterKeyBundle) (
+	TLFWriterKeyGenerations, error) {
+	if len(tkg) > 0 && !tkg.IsWriter(crypto, writerVerifyingKey, caller, callerDevice) {
+		return nil, NotATLFWriterError{caller, callerDevice}
+	}
+	return append(tkg, newBundle), nil
 }
 
 type TLFKeyMap map[keybase1.UID]UserCryptKeyBundle
@@ -151,23 +288,127 @@ func (tkm TLFKeyMap) DeepCopy() TLFKeyMap {
 	return keys
 }
 
+// canonicalCryptKeyInfoEntry is one device's entry from a
+// UserCryptKeyBundle, pulled out of the map into something with a
+// fixed field order for canonicalUserCryptKeyBundle.
+type canonicalCryptKeyInfoEntry struct {
+	KID  keybase1.KID
+	Info TLFCryptKeyInfo
+}
+
+// canonicalUserCryptKeyBundle is a UserCryptKeyBundle re-expressed as
+// a slice sorted by KID, so encoding it doesn't depend on Go's
+// randomized map iteration order the way encoding the map directly
+// would.
+type canonicalUserCryptKeyBundle []canonicalCryptKeyInfoEntry
+
+// canonicalize returns uckb as a canonicalUserCryptKeyBundle.
+func (uckb UserCryptKeyBundle) canonicalize() canonicalUserCryptKeyBundle {
+	kids := uckb.GetKIDs()
+	sort.Slice(kids, func(i, j int) bool { return kids[i].String() < kids[j].String() })
+	out := make(canonicalUserCryptKeyBundle, len(kids))
+	for i, kid := range kids {
+		out[i] = canonicalCryptKeyInfoEntry{KID: kid, Info: uckb[kid]}
+	}
+	return out
+}
+
+// canonicalTLFKeyMapEntry is one user's entry from a TLFKeyMap, pulled
+// out of the map into something with a fixed field order for
+// canonicalTLFKeyMap.
+type canonicalTLFKeyMapEntry struct {
+	UID    keybase1.UID
+	Bundle canonicalUserCryptKeyBundle
+}
+
+// canonicalTLFKeyMap is a TLFKeyMap re-expressed as a slice sorted by
+// UID, for the same reason canonicalUserCryptKeyBundle exists: so
+// TLFWriterKeyBundle.signedBytes/TLFReaderKeyBundle.signedBytes
+// produce identical bytes for identical logical content no matter
+// what order its entries were inserted into the underlying maps in.
+type canonicalTLFKeyMap []canonicalTLFKeyMapEntry
+
+// canonicalize returns tkm as a canonicalTLFKeyMap.
+func (tkm TLFKeyMap) canonicalize() canonicalTLFKeyMap {
+	uids := make([]keybase1.UID, 0, len(tkm))
+	for u := range tkm {
+		uids = append(uids, u)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i].String() < uids[j].String() })
+	out := make(canonicalTLFKeyMap, len(uids))
+	for i, u := range uids {
+		out[i] = canonicalTLFKeyMapEntry{UID: u, Bundle: tkm[u].canonicalize()}
+	}
+	return out
+}
+
 type TLFReaderKeyBundle struct {
 	RKeys TLFKeyMap
+
+	// RKeyBundleSig is the signature, by the writer's device signing
+	// key at rekey time, over the canonical encoding of this bundle
+	// with RKeyBundleSig itself zeroed out. A reader is only trusted
+	// once this signature is checked, so a bserver can't silently drop
+	// a device from RKeys.
+	RKeyBundleSig SignatureInfo `codec:"sig,omitempty"`
 }
 
 // DeepCopy returns a complete copy of this TLFReaderKeyBundle.
 func (trb *TLFReaderKeyBundle) DeepCopy() *TLFReaderKeyBundle {
 	return &TLFReaderKeyBundle{
-		RKeys: trb.RKeys.DeepCopy(),
+		RKeys:         trb.RKeys.DeepCopy(),
+		RKeyBundleSig: trb.RKeyBundleSig.DeepCopy(),
 	}
 }
 
+// canonicalTLFReaderKeyBundle is the content of a TLFReaderKeyBundle
+// that RKeyBundleSig signs over: everything except the signature
+// itself, with RKeys canonicalized so the signed bytes don't depend on
+// Go's randomized map iteration order.
+type canonicalTLFReaderKeyBundle struct {
+	RKeys canonicalTLFKeyMap
+}
+
+// signedBytes returns the canonical (codec) encoding of trb's content
+// excluding RKeyBundleSig, i.e. the bytes that RKeyBundleSig is a
+// signature over.
+func (trb TLFReaderKeyBundle) signedBytes(codec Codec) ([]byte, error) {
+	return codec.Encode(canonicalTLFReaderKeyBundle{RKeys: trb.RKeys.canonicalize()})
+}
+
 // IsReader returns true if the given user device is in the reader set.
 func (trb TLFReaderKeyBundle) IsReader(user keybase1.UID, deviceKID keybase1.KID) bool {
 	_, ok := trb.RKeys[user][deviceKID]
 	return ok
 }
 
+// sign (re-)computes RKeyBundleSig over trb's current content using
+// crypto's own device signing key; like TLFWriterKeyBundle.sign, it's
+// the writer's device that signs, since only a writer can rekey.
+func (trb *TLFReaderKeyBundle) sign(ctx context.Context, crypto Crypto) error {
+	msg, err := trb.signedBytes(crypto.Codec())
+	if err != nil {
+		return err
+	}
+	sig, err := crypto.Sign(ctx, msg)
+	if err != nil {
+		return err
+	}
+	trb.RKeyBundleSig = sig
+	return nil
+}
+
+// Verify checks that RKeyBundleSig was produced by writerVerifyingKey
+// over this bundle's own content, so a caller can detect a bserver
+// that silently dropped a device from RKeys since the last rekey.
+func (trb TLFReaderKeyBundle) Verify(crypto Crypto, writerVerifyingKey VerifyingKey) error {
+	readerBytes, err := trb.signedBytes(crypto.Codec())
+	if err != nil {
+		return err
+	}
+	return crypto.Verify(readerBytes, trb.RKeyBundleSig, writerVerifyingKey)
+}
+
 type TLFReaderKeyGenerations []*TLFReaderKeyBundle
 
 // GetKeyGeneration returns the current key generation for this TLF.
@@ -184,14 +425,48 @@ func (trg TLFReaderKeyGenerations) DeepCopy() TLFReaderKeyGenerations {
 	return keys
 }
 
-// IsReader returns whether or not the user+device is an authorized reader
-// for the latest generation.
-func (tkg TLFReaderKeyGenerations) IsReader(user keybase1.UID, deviceKID keybase1.KID) bool {
+// Append adds newBundle as the next key generation, returning the
+// extended generations slice. Unlike TLFWriterKeyGenerations.Append,
+// this needs no writer-gating check of its own: a new reader
+// generation is only ever produced alongside a new writer generation
+// as part of the same rekey (see Rotate), and that rekey is already
+// gated by the writer-generations Append.
+func (trg TLFReaderKeyGenerations) Append(
+	newBundle *TLFReaderKeyBundle) TLFReaderKeyGenerations {
+	return append(trg, newBundle)
+}
+
+// IsReader returns whether or not the user+device is an authorized
+// reader for the latest generation. As with
+// TLFWriterKeyGenerations.IsWriter, this fails closed if the latest
+// generation's RKeyBundleSig doesn't verify against
+// writerVerifyingKey.
+func (tkg TLFReaderKeyGenerations) IsReader(crypto Crypto, writerVerifyingKey VerifyingKey,
+	user keybase1.UID, deviceKID keybase1.KID) bool {
 	keyGen := tkg.GetKeyGeneration()
 	if keyGen < 1 {
 		return false
 	}
-	return tkg[keyGen-1].IsReader(user, deviceKID)
+	latest := tkg[keyGen-1]
+	if err := latest.Verify(crypto, writerVerifyingKey); err != nil {
+		return false
+	}
+	return latest.IsReader(user, deviceKID)
+}
+
+// SignatureInfo contains everything needed to verify a signature
+// produced by a device's signing key: the KID of the key that should
+// verify it, and the raw signature bytes.
+type SignatureInfo struct {
+	VerifyingKey keybase1.KID
+	Sig          []byte
+}
+
+// DeepCopy returns a complete copy of a SignatureInfo.
+func (si SignatureInfo) DeepCopy() SignatureInfo {
+	sig := make([]byte, len(si.Sig))
+	copy(sig, si.Sig)
+	return SignatureInfo{VerifyingKey: si.VerifyingKey, Sig: sig}
 }
 
 // TLFKeyBundle is a bundle of all the keys for a top-level folder.
@@ -209,6 +484,13 @@ type TLFWriterKeyBundle struct {
 	// one used by a particular device is specified by EPubKeyIndex in
 	// its TLFCryptoKeyInfo struct.
 	TLFEphemeralPublicKeys TLFEphemeralPublicKeys `codec:"ePubKey"`
+
+	// WriterMetadataSig is the signature, by the writer's device
+	// signing key at rekey time, over the canonical encoding of this
+	// bundle with WriterMetadataSig itself zeroed out. It lets a
+	// reader detect a bserver that has tampered with WKeys or a
+	// TLFEphemeralPublicKey since the last rekey.
+	WriterMetadataSig SignatureInfo `codec:"sig,omitempty"`
 }
 
 // DeepCopy returns a complete copy of this TLFWriterKeyBundle.
@@ -217,15 +499,67 @@ func (tkb *TLFWriterKeyBundle) DeepCopy() *TLFWriterKeyBundle {
 		WKeys:                  tkb.WKeys.DeepCopy(),
 		TLFPublicKey:           tkb.TLFPublicKey.DeepCopy(),
 		TLFEphemeralPublicKeys: tkb.TLFEphemeralPublicKeys.DeepCopy(),
+		WriterMetadataSig:      tkb.WriterMetadataSig.DeepCopy(),
 	}
 }
 
+// canonicalTLFWriterKeyBundle is the content of a TLFWriterKeyBundle
+// that WriterMetadataSig signs over: everything except the signature
+// itself, with WKeys canonicalized so the signed bytes don't depend on
+// Go's randomized map iteration order.
+type canonicalTLFWriterKeyBundle struct {
+	WKeys                  canonicalTLFKeyMap
+	TLFPublicKey           TLFPublicKey
+	TLFEphemeralPublicKeys TLFEphemeralPublicKeys
+}
+
+// signedBytes returns the canonical (codec) encoding of tkb's content
+// excluding WriterMetadataSig, i.e. the bytes that WriterMetadataSig
+// is a signature over.
+func (tkb TLFWriterKeyBundle) signedBytes(codec Codec) ([]byte, error) {
+	return codec.Encode(canonicalTLFWriterKeyBundle{
+		WKeys:                  tkb.WKeys.canonicalize(),
+		TLFPublicKey:           tkb.TLFPublicKey,
+		TLFEphemeralPublicKeys: tkb.TLFEphemeralPublicKeys,
+	})
+}
+
 // IsWriter returns true if the given user device is in the writer set.
 func (tkb TLFWriterKeyBundle) IsWriter(user keybase1.UID, deviceKID keybase1.KID) bool {
 	_, ok := tkb.WKeys[user][deviceKID]
 	return ok
 }
 
+// sign (re-)computes WriterMetadataSig over tkb's current content using
+// crypto's own device signing key, called once a bundle's WKeys and
+// TLFEphemeralPublicKeys are final so the signature covers what's
+// actually being uploaded.
+func (tkb *TLFWriterKeyBundle) sign(ctx context.Context, crypto Crypto) error {
+	msg, err := tkb.signedBytes(crypto.Codec())
+	if err != nil {
+		return err
+	}
+	sig, err := crypto.Sign(ctx, msg)
+	if err != nil {
+		return err
+	}
+	tkb.WriterMetadataSig = sig
+	return nil
+}
+
+// Verify checks that WriterMetadataSig was produced by
+// writerVerifyingKey over this bundle's own content, so a caller can
+// detect a bserver that silently dropped a device from WKeys or
+// swapped in an unauthorized TLFEphemeralPublicKey since the last
+// rekey.
+func (tkb TLFWriterKeyBundle) Verify(crypto Crypto, writerVerifyingKey VerifyingKey) error {
+	writerBytes, err := tkb.signedBytes(crypto.Codec())
+	if err != nil {
+		return err
+	}
+	return crypto.Verify(writerBytes, tkb.WriterMetadataSig, writerVerifyingKey)
+}
+
 // TLFKeyBundle is a bundle of all the keys for a top-level folder.
 type TLFKeyBundle struct {
 	*TLFWriterKeyBundle
@@ -243,6 +577,31 @@ func NewTLFKeyBundle() *TLFKeyBundle {
 	}
 }
 
+// sign (re-)computes both WriterMetadataSig and RKeyBundleSig, called
+// once fillInDevices has finished mutating tkb's WKeys/RKeys/
+// TLFEphemeralPublicKeys for a rekey so the bundle a writer uploads is
+// self-consistently signed.
+func (tkb TLFKeyBundle) sign(ctx context.Context, crypto Crypto) error {
+	if err := tkb.TLFWriterKeyBundle.sign(ctx, crypto); err != nil {
+		return err
+	}
+	return tkb.TLFReaderKeyBundle.sign(ctx, crypto)
+}
+
+// Verify checks that WriterMetadataSig and RKeyBundleSig were both
+// produced by writerVerifyingKey over this bundle's own content. This
+// closes a class of attacks where a malicious bserver silently drops
+// a device from WKeys/RKeys or swaps in an unauthorized
+// TLFEphemeralPublicKey: callers should invoke Verify before trusting
+// IsWriter/IsReader results computed from a bundle fetched from the
+// server.
+func (tkb TLFKeyBundle) Verify(crypto Crypto, writerVerifyingKey VerifyingKey) error {
+	if err := tkb.TLFWriterKeyBundle.Verify(crypto, writerVerifyingKey); err != nil {
+		return err
+	}
+	return tkb.TLFReaderKeyBundle.Verify(crypto, writerVerifyingKey)
+}
+
 // DeepCopy returns a complete copy of this TLFKeyBundle.
 func (tkb TLFKeyBundle) DeepCopy() TLFKeyBundle {
 	return TLFKeyBundle{
@@ -253,18 +612,19 @@ func (tkb TLFKeyBundle) DeepCopy() TLFKeyBundle {
 
 type serverKeyMap map[keybase1.UID]map[keybase1.KID]TLFCryptKeyServerHalf
 
-func fillInDevicesAndServerMap(crypto Crypto, newIndex int,
+func fillInDevicesAndServerMap(ctx context.Context, crypto Crypto, newIndex int,
 	cryptKeys map[keybase1.UID][]CryptPublicKey,
 	cryptBundles map[keybase1.UID]UserCryptKeyBundle,
 	ePubKey TLFEphemeralPublicKey, ePrivKey TLFEphemeralPrivateKey,
-	tlfCryptKey TLFCryptKey, newServerKeys serverKeyMap) error {
+	tlfCryptKey TLFCryptKey, newServerKeys serverKeyMap,
+	kinds map[keybase1.KID]DeviceKeyKind, numWorkers int) error {
 	for u, keys := range cryptKeys {
 		if _, ok := cryptBundles[u]; !ok {
 			cryptBundles[u] = UserCryptKeyBundle{}
 		}
 
 		serverMap, err := cryptBundles[u].fillInDeviceInfo(
-			crypto, u, tlfCryptKey, ePrivKey, newIndex, keys)
+			ctx, crypto, u, tlfCryptKey, ePrivKey, newIndex, keys, kinds, numWorkers)
 		if err != nil {
 			return err
 		}
@@ -278,11 +638,18 @@ func fillInDevicesAndServerMap(crypto Crypto, newIndex int,
 // fillInDevices ensures that every device for every writer and reader
 // in the provided lists has complete TLF crypt key info, and uses the
 // new ephemeral key pair to generate the info if it doesn't yet
-// exist.
-func (tkb TLFKeyBundle) fillInDevices(crypto Crypto,
+// exist. kinds optionally records the DeviceKeyKind of any non-local
+// (e.g. hardware) devices in wKeys/rKeys by KID; devices absent from
+// it default to DeviceKeyKindLocal. Per-device work is parallelized
+// across a worker pool bounded by numWorkers (or defaultKeyHalfWorkers
+// if numWorkers <= 0), so callers that know their deployment's
+// CPU/RPC budget can tune it instead of always taking the GOMAXPROCS
+// default; ctx governs cancellation of that work.
+func (tkb TLFKeyBundle) fillInDevices(ctx context.Context, crypto Crypto,
 	wKeys map[keybase1.UID][]CryptPublicKey,
 	rKeys map[keybase1.UID][]CryptPublicKey, ePubKey TLFEphemeralPublicKey,
-	ePrivKey TLFEphemeralPrivateKey, tlfCryptKey TLFCryptKey) (
+	ePrivKey TLFEphemeralPrivateKey, tlfCryptKey TLFCryptKey,
+	kinds map[keybase1.KID]DeviceKeyKind, numWorkers int) (
 	serverKeyMap, error) {
 	tkb.TLFEphemeralPublicKeys =
 		append(tkb.TLFEphemeralPublicKeys, ePubKey)
@@ -290,19 +657,127 @@ func (tkb TLFKeyBundle) fillInDevices(crypto Crypto,
 
 	// now fill in the secret keys as needed
 	newServerKeys := serverKeyMap{}
-	err := fillInDevicesAndServerMap(crypto, newIndex, wKeys, tkb.WKeys,
-		ePubKey, ePrivKey, tlfCryptKey, newServerKeys)
+	err := fillInDevicesAndServerMap(ctx, crypto, newIndex, wKeys, tkb.WKeys,
+		ePubKey, ePrivKey, tlfCryptKey, newServerKeys, kinds, numWorkers)
 	if err != nil {
 		return nil, err
 	}
-	err = fillInDevicesAndServerMap(crypto, newIndex, rKeys, tkb.RKeys,
-		ePubKey, ePrivKey, tlfCryptKey, newServerKeys)
+	err = fillInDevicesAndServerMap(ctx, crypto, newIndex, rKeys, tkb.RKeys,
+		ePubKey, ePrivKey, tlfCryptKey, newServerKeys, kinds, numWorkers)
 	if err != nil {
 		return nil, err
 	}
+
+	// The bundle is now final; sign it so a reader can detect a
+	// bserver that tampers with it afterwards.
+	if err := tkb.sign(ctx, crypto); err != nil {
+		return nil, err
+	}
+
 	return newServerKeys, nil
 }
 
+// NotATLFKeyGenerationError is returned by Rotate when wGens has no
+// existing key generation to rotate away from.
+type NotATLFKeyGenerationError struct{}
+
+func (NotATLFKeyGenerationError) Error() string {
+	return "Rotate requires at least one existing key generation"
+}
+
+// Rotate cuts a set of revoked devices out of future access by
+// generating a brand-new TLFCryptKey and appending an entirely fresh
+// key generation, populated only with the non-revoked devices in
+// wKeys and rKeys, to wGens/rGens; it does not reuse any existing
+// generation's WKeys/RKeys/ephemeral keys at all, since a revoked
+// device must not be able to derive the new TLFCryptKey from anything
+// it already has. The append is gated exactly like
+// TLFWriterKeyGenerations.Append: caller/callerDevice must verify as a
+// writer at wGens' latest generation, or Rotate fails with a
+// NotATLFWriterError, so a revoked device can't rotate itself back in.
+// kinds is passed straight through to fillInDevices so surviving
+// hardware/paper devices keep their DeviceKind in the new generation
+// instead of reverting to DeviceKeyKindLocal. currentCryptKey is the
+// TLFCryptKey being rotated away from; Rotate returns it unchanged so
+// the caller can re-encrypt any block keys that were protected under
+// it, alongside the extended generations and the serverKeyMap to
+// upload for the new generation. The new TLFCryptKey itself is not
+// returned.
+func Rotate(ctx context.Context, crypto Crypto, writerVerifyingKey VerifyingKey,
+	caller keybase1.UID, callerDevice keybase1.KID,
+	wGens TLFWriterKeyGenerations, rGens TLFReaderKeyGenerations,
+	currentCryptKey TLFCryptKey,
+	wKeys map[keybase1.UID][]CryptPublicKey,
+	rKeys map[keybase1.UID][]CryptPublicKey,
+	revoked map[keybase1.UID][]keybase1.KID,
+	kinds map[keybase1.KID]DeviceKeyKind, numWorkers int) (
+	TLFWriterKeyGenerations, TLFReaderKeyGenerations, TLFCryptKey, serverKeyMap, error) {
+	if wGens.GetKeyGeneration() < 1 {
+		return nil, nil, TLFCryptKey{}, nil, NotATLFKeyGenerationError{}
+	}
+	latest := wGens[len(wGens)-1]
+
+	newCryptKey, err := crypto.MakeRandomTLFCryptKey()
+	if err != nil {
+		return nil, nil, TLFCryptKey{}, nil, err
+	}
+
+	ePubKey, ePrivKey, err := crypto.MakeRandomTLFEphemeralKeys()
+	if err != nil {
+		return nil, nil, TLFCryptKey{}, nil, err
+	}
+
+	newWriterBundle := &TLFWriterKeyBundle{
+		WKeys:        make(TLFKeyMap),
+		TLFPublicKey: latest.TLFPublicKey,
+	}
+	newReaderBundle := &TLFReaderKeyBundle{RKeys: make(TLFKeyMap)}
+	newBundle := TLFKeyBundle{newWriterBundle, newReaderBundle}
+
+	newServerKeys, err := newBundle.fillInDevices(ctx, crypto,
+		withoutRevokedDevices(wKeys, revoked),
+		withoutRevokedDevices(rKeys, revoked),
+		ePubKey, ePrivKey, newCryptKey, kinds, numWorkers)
+	if err != nil {
+		return nil, nil, TLFCryptKey{}, nil, err
+	}
+
+	newWGens, err := wGens.Append(
+		crypto, writerVerifyingKey, caller, callerDevice, newWriterBundle)
+	if err != nil {
+		return nil, nil, TLFCryptKey{}, nil, err
+	}
+	newRGens := rGens.Append(newReaderBundle)
+
+	return newWGens, newRGens, currentCryptKey, newServerKeys, nil
+}
+
+// withoutRevokedDevices returns a copy of keys with every KID listed
+// for a user in revoked removed from that user's device list.
+func withoutRevokedDevices(keys map[keybase1.UID][]CryptPublicKey,
+	revoked map[keybase1.UID][]keybase1.KID) map[keybase1.UID][]CryptPublicKey {
+	if len(revoked) == 0 {
+		return keys
+	}
+
+	out := make(map[keybase1.UID][]CryptPublicKey, len(keys))
+	for u, devices := range keys {
+		revokedForUser := make(map[keybase1.KID]bool, len(revoked[u]))
+		for _, kid := range revoked[u] {
+			revokedForUser[kid] = true
+		}
+
+		var kept []CryptPublicKey
+		for _, d := range devices {
+			if !revokedForUser[d.KID] {
+				kept = append(kept, d)
+			}
+		}
+		out[u] = kept
+	}
+	return out
+}
+
 // GetTLFCryptKeyInfo returns the TLFCryptKeyInfo entry for the given user
 // and device.
 func (tkb TLFKeyBundle) GetTLFCryptKeyInfo(user keybase1.UID,
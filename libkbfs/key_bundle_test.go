@@ -0,0 +1,433 @@
+package libkbfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+)
+
+// signTestCodec is a trivial Codec fake: it encodes a value as its Go
+// %+v representation, which is all signedBytes needs (a deterministic
+// byte string that changes if the value does).
+type signTestCodec struct{}
+
+func (signTestCodec) Encode(obj interface{}) ([]byte, error) {
+	return []byte(fmt.Sprintf("%+v", obj)), nil
+}
+
+// signTestCrypto implements just the Crypto methods TLFKeyBundle's
+// sign/Verify call: Codec, Sign, and Verify. Sign always succeeds
+// using signerKID as the signing device; Verify accepts only
+// signatures it produced itself for the matching verifying key.
+type signTestCrypto struct {
+	Crypto
+	signerKID keybase1.KID
+}
+
+func (c *signTestCrypto) Codec() Codec {
+	return signTestCodec{}
+}
+
+func (c *signTestCrypto) Sign(ctx context.Context, msg []byte) (SignatureInfo, error) {
+	sig := make([]byte, len(msg))
+	copy(sig, msg)
+	return SignatureInfo{VerifyingKey: c.signerKID, Sig: sig}, nil
+}
+
+func (c *signTestCrypto) Verify(msg []byte, sig SignatureInfo, verifyingKey VerifyingKey) error {
+	if sig.VerifyingKey != verifyingKey.KID {
+		return fmt.Errorf("signature is by %v, not %v", sig.VerifyingKey, verifyingKey.KID)
+	}
+	if string(sig.Sig) != string(msg) {
+		return errors.New("signature does not match signed content")
+	}
+	return nil
+}
+
+// fillInDeviceInfoTestCrypto implements just the Crypto methods
+// fillInDeviceInfo calls, with knobs to inject per-device errors and
+// artificial delays so tests can control which goroutine in the
+// worker pool finishes first.
+type fillInDeviceInfoTestCrypto struct {
+	Crypto
+	failErrs map[keybase1.KID]error
+	delays   map[keybase1.KID]time.Duration
+}
+
+func (c *fillInDeviceInfoTestCrypto) MakeRandomTLFCryptKeyServerHalf() (
+	TLFCryptKeyServerHalf, error) {
+	return TLFCryptKeyServerHalf{}, nil
+}
+
+func (c *fillInDeviceInfoTestCrypto) MaskTLFCryptKey(
+	TLFCryptKeyServerHalf, TLFCryptKey) (TLFCryptKeyClientHalf, error) {
+	return TLFCryptKeyClientHalf{}, nil
+}
+
+func (c *fillInDeviceInfoTestCrypto) EncryptTLFCryptKeyClientHalf(
+	TLFEphemeralPrivateKey, CryptPublicKey, TLFCryptKeyClientHalf) (
+	EncryptedTLFCryptKeyClientHalf, error) {
+	return EncryptedTLFCryptKeyClientHalf{}, nil
+}
+
+func (c *fillInDeviceInfoTestCrypto) GetTLFCryptKeyServerHalfID(
+	uid keybase1.UID, kid keybase1.KID, half TLFCryptKeyServerHalf) (
+	TLFCryptKeyServerHalfID, error) {
+	if d, ok := c.delays[kid]; ok {
+		time.Sleep(d)
+	}
+	if err, ok := c.failErrs[kid]; ok {
+		return TLFCryptKeyServerHalfID{}, err
+	}
+	return TLFCryptKeyServerHalfID{}, nil
+}
+
+func testCryptPublicKeys(n int) []CryptPublicKey {
+	devices := make([]CryptPublicKey, n)
+	for i := range devices {
+		devices[i] = CryptPublicKey{KID: keybase1.KID(string(rune('a' + i)))}
+	}
+	return devices
+}
+
+func TestFillInDeviceInfoParallelResults(t *testing.T) {
+	devices := testCryptPublicKeys(8)
+	crypto := &fillInDeviceInfoTestCrypto{}
+
+	uckb := UserCryptKeyBundle{}
+	serverMap, err := uckb.fillInDeviceInfo(context.Background(), crypto,
+		keybase1.UID(""), TLFCryptKey{}, TLFEphemeralPrivateKey{}, 0,
+		devices, nil /* kinds */, 3 /* numWorkers, fewer than len(devices) */)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(uckb) != len(devices) {
+		t.Fatalf("got %d bundle entries, want %d", len(uckb), len(devices))
+	}
+	if len(serverMap) != len(devices) {
+		t.Fatalf("got %d server halves, want %d", len(serverMap), len(devices))
+	}
+	for _, d := range devices {
+		if _, ok := uckb[d.KID]; !ok {
+			t.Errorf("missing bundle entry for %v", d.KID)
+		}
+		if _, ok := serverMap[d.KID]; !ok {
+			t.Errorf("missing server half for %v", d.KID)
+		}
+	}
+}
+
+func TestFillInDeviceInfoSkipsExistingEntries(t *testing.T) {
+	devices := testCryptPublicKeys(4)
+	crypto := &fillInDeviceInfoTestCrypto{}
+
+	uckb := UserCryptKeyBundle{devices[0].KID: TLFCryptKeyInfo{EPubKeyIndex: 7}}
+	_, err := uckb.fillInDeviceInfo(context.Background(), crypto,
+		keybase1.UID(""), TLFCryptKey{}, TLFEphemeralPrivateKey{}, 1, devices, nil, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if uckb[devices[0].KID].EPubKeyIndex != 7 {
+		t.Errorf("existing entry for %v was overwritten", devices[0].KID)
+	}
+	for _, d := range devices[1:] {
+		if uckb[d.KID].EPubKeyIndex != 1 {
+			t.Errorf("new entry for %v has EPubKeyIndex %d, want 1",
+				d.KID, uckb[d.KID].EPubKeyIndex)
+		}
+	}
+}
+
+// TestFillInDeviceInfoFirstErrorInInputOrder makes the *earlier*
+// device's goroutine the slow one so that, if fillInDeviceInfo picked
+// whichever error arrived first instead of the first one in
+// publicKeys order, this test would observe the later device's error
+// instead.
+func TestFillInDeviceInfoFirstErrorInInputOrder(t *testing.T) {
+	devices := testCryptPublicKeys(4)
+	errA := errors.New("device 1 failed")
+	errB := errors.New("device 2 failed")
+
+	crypto := &fillInDeviceInfoTestCrypto{
+		failErrs: map[keybase1.KID]error{
+			devices[1].KID: errA,
+			devices[2].KID: errB,
+		},
+		delays: map[keybase1.KID]time.Duration{
+			devices[1].KID: 20 * time.Millisecond,
+		},
+	}
+
+	uckb := UserCryptKeyBundle{}
+	_, err := uckb.fillInDeviceInfo(context.Background(), crypto,
+		keybase1.UID(""), TLFCryptKey{}, TLFEphemeralPrivateKey{}, 0, devices, nil, 4)
+	if err != errA {
+		t.Fatalf("got error %v, want %v", err, errA)
+	}
+}
+
+func TestFillInDeviceInfoRespectsCancellation(t *testing.T) {
+	devices := testCryptPublicKeys(4)
+	crypto := &fillInDeviceInfoTestCrypto{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	uckb := UserCryptKeyBundle{}
+	_, err := uckb.fillInDeviceInfo(ctx, crypto,
+		keybase1.UID(""), TLFCryptKey{}, TLFEphemeralPrivateKey{}, 0, devices, nil, 2)
+	if err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestTLFKeyBundleSignAndVerify(t *testing.T) {
+	crypto := &signTestCrypto{signerKID: keybase1.KID("writer-device")}
+	verifyingKey := VerifyingKey{KID: crypto.signerKID}
+
+	tkb := NewTLFKeyBundle()
+	if err := tkb.sign(context.Background(), crypto); err != nil {
+		t.Fatalf("unexpected error signing: %v", err)
+	}
+
+	if err := tkb.Verify(crypto, verifyingKey); err != nil {
+		t.Fatalf("unexpected error verifying freshly-signed bundle: %v", err)
+	}
+}
+
+func TestTLFWriterKeyBundleSignedBytesIndependentOfMapInsertionOrder(t *testing.T) {
+	crypto := &signTestCrypto{signerKID: keybase1.KID("writer-device")}
+	codec := crypto.Codec()
+
+	uidA, uidB := keybase1.UID("alice"), keybase1.UID("bob")
+	kidA, kidB := keybase1.KID("alice-device"), keybase1.KID("bob-device")
+
+	buildBundle := func(uids []keybase1.UID, kids []keybase1.KID) *TLFWriterKeyBundle {
+		tkb := &TLFWriterKeyBundle{WKeys: make(TLFKeyMap)}
+		for _, u := range uids {
+			tkb.WKeys[u] = UserCryptKeyBundle{}
+		}
+		for i, u := range uids {
+			tkb.WKeys[u][kids[i]] = TLFCryptKeyInfo{EPubKeyIndex: i}
+		}
+		return tkb
+	}
+
+	// Same logical content, built via two different insertion orders.
+	first := buildBundle([]keybase1.UID{uidA, uidB}, []keybase1.KID{kidA, kidB})
+	second := buildBundle([]keybase1.UID{uidB, uidA}, []keybase1.KID{kidB, kidA})
+
+	firstBytes, err := first.signedBytes(codec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secondBytes, err := second.signedBytes(codec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(firstBytes) != string(secondBytes) {
+		t.Fatalf("signedBytes depends on map insertion order:\nfirst:  %q\nsecond: %q",
+			firstBytes, secondBytes)
+	}
+}
+
+func TestTLFKeyBundleVerifyDetectsTampering(t *testing.T) {
+	crypto := &signTestCrypto{signerKID: keybase1.KID("writer-device")}
+	verifyingKey := VerifyingKey{KID: crypto.signerKID}
+
+	tkb := NewTLFKeyBundle()
+	if err := tkb.sign(context.Background(), crypto); err != nil {
+		t.Fatalf("unexpected error signing: %v", err)
+	}
+
+	// A bserver silently adding a device to WKeys after the signature
+	// was produced must be caught by Verify.
+	tkb.WKeys[keybase1.UID("mallory")] = UserCryptKeyBundle{
+		keybase1.KID("mallory-device"): TLFCryptKeyInfo{},
+	}
+
+	if err := tkb.Verify(crypto, verifyingKey); err == nil {
+		t.Fatal("expected Verify to reject a bundle tampered with after signing")
+	}
+}
+
+func TestTLFWriterKeyGenerationsIsWriterFailsClosedOnBadSignature(t *testing.T) {
+	crypto := &signTestCrypto{signerKID: keybase1.KID("writer-device")}
+	verifyingKey := VerifyingKey{KID: crypto.signerKID}
+	user := keybase1.UID("alice")
+
+	bundle := &TLFWriterKeyBundle{
+		WKeys: TLFKeyMap{user: UserCryptKeyBundle{crypto.signerKID: TLFCryptKeyInfo{}}},
+	}
+	// Never signed, so WriterMetadataSig is the zero value and Verify
+	// must fail.
+	gens := TLFWriterKeyGenerations{bundle}
+
+	if gens.IsWriter(crypto, verifyingKey, user, crypto.signerKID) {
+		t.Fatal("expected IsWriter to fail closed for an unsigned bundle")
+	}
+
+	if err := bundle.sign(context.Background(), crypto); err != nil {
+		t.Fatalf("unexpected error signing: %v", err)
+	}
+	if !gens.IsWriter(crypto, verifyingKey, user, crypto.signerKID) {
+		t.Fatal("expected IsWriter to succeed once the bundle is validly signed")
+	}
+}
+
+func TestTLFWriterKeyGenerationsAppendRejectsNonWriter(t *testing.T) {
+	crypto := &signTestCrypto{signerKID: keybase1.KID("writer-device")}
+	verifyingKey := VerifyingKey{KID: crypto.signerKID}
+	writer := keybase1.UID("alice")
+	mallory := keybase1.UID("mallory")
+
+	first := &TLFWriterKeyBundle{
+		WKeys: TLFKeyMap{writer: UserCryptKeyBundle{crypto.signerKID: TLFCryptKeyInfo{}}},
+	}
+	if err := first.sign(context.Background(), crypto); err != nil {
+		t.Fatalf("unexpected error signing: %v", err)
+	}
+	gens := TLFWriterKeyGenerations{first}
+
+	second := &TLFWriterKeyBundle{}
+	_, err := gens.Append(crypto, verifyingKey, mallory, keybase1.KID("mallory-device"), second)
+	if _, ok := err.(NotATLFWriterError); !ok {
+		t.Fatalf("got error %v, want NotATLFWriterError", err)
+	}
+
+	newGens, err := gens.Append(crypto, verifyingKey, writer, crypto.signerKID, second)
+	if err != nil {
+		t.Fatalf("unexpected error appending on behalf of an actual writer: %v", err)
+	}
+	if newGens.GetKeyGeneration() != 2 {
+		t.Fatalf("got generation %d, want 2", newGens.GetKeyGeneration())
+	}
+}
+
+type rotateTestCrypto struct {
+	signTestCrypto
+}
+
+func (c *rotateTestCrypto) MakeRandomTLFCryptKeyServerHalf() (TLFCryptKeyServerHalf, error) {
+	return TLFCryptKeyServerHalf{}, nil
+}
+
+func (c *rotateTestCrypto) MaskTLFCryptKey(TLFCryptKeyServerHalf, TLFCryptKey) (
+	TLFCryptKeyClientHalf, error) {
+	return TLFCryptKeyClientHalf{}, nil
+}
+
+func (c *rotateTestCrypto) EncryptTLFCryptKeyClientHalf(TLFEphemeralPrivateKey,
+	CryptPublicKey, TLFCryptKeyClientHalf) (EncryptedTLFCryptKeyClientHalf, error) {
+	return EncryptedTLFCryptKeyClientHalf{}, nil
+}
+
+func (c *rotateTestCrypto) GetTLFCryptKeyServerHalfID(keybase1.UID, keybase1.KID,
+	TLFCryptKeyServerHalf) (TLFCryptKeyServerHalfID, error) {
+	return TLFCryptKeyServerHalfID{}, nil
+}
+
+func (c *rotateTestCrypto) MakeRandomTLFCryptKey() (TLFCryptKey, error) {
+	return TLFCryptKey{}, nil
+}
+
+func (c *rotateTestCrypto) MakeRandomTLFEphemeralKeys() (
+	TLFEphemeralPublicKey, TLFEphemeralPrivateKey, error) {
+	return TLFEphemeralPublicKey{}, TLFEphemeralPrivateKey{}, nil
+}
+
+func TestRotateExcludesRevokedDevices(t *testing.T) {
+	crypto := &rotateTestCrypto{signTestCrypto{signerKID: keybase1.KID("writer-device")}}
+	verifyingKey := VerifyingKey{KID: crypto.signerKID}
+	writer := keybase1.UID("alice")
+
+	firstWriter := &TLFWriterKeyBundle{
+		WKeys: TLFKeyMap{writer: UserCryptKeyBundle{crypto.signerKID: TLFCryptKeyInfo{}}},
+	}
+	if err := firstWriter.sign(context.Background(), crypto); err != nil {
+		t.Fatalf("unexpected error signing: %v", err)
+	}
+	wGens := TLFWriterKeyGenerations{firstWriter}
+	rGens := TLFReaderKeyGenerations{&TLFReaderKeyBundle{RKeys: TLFKeyMap{}}}
+
+	revokedDevice := keybase1.KID("revoked-device")
+	hardwareDevice := keybase1.KID("hardware-device")
+	wKeys := map[keybase1.UID][]CryptPublicKey{
+		writer: {
+			{KID: crypto.signerKID},
+			{KID: revokedDevice},
+			{KID: hardwareDevice},
+		},
+	}
+	revoked := map[keybase1.UID][]keybase1.KID{writer: {revokedDevice}}
+	kinds := map[keybase1.KID]DeviceKeyKind{hardwareDevice: DeviceKeyKindHardware}
+
+	newWGens, newRGens, _, _, err := Rotate(context.Background(), crypto, verifyingKey,
+		writer, crypto.signerKID, wGens, rGens, TLFCryptKey{}, wKeys, nil, revoked, kinds, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if newRGens.GetKeyGeneration() != 2 {
+		t.Fatalf("got reader generation %d, want 2", newRGens.GetKeyGeneration())
+	}
+
+	latest := newWGens[len(newWGens)-1]
+	if _, ok := latest.WKeys[writer][revokedDevice]; ok {
+		t.Error("revoked device still has an entry in the new generation")
+	}
+	if _, ok := latest.WKeys[writer][crypto.signerKID]; !ok {
+		t.Error("non-revoked device is missing from the new generation")
+	}
+	if got := latest.WKeys[writer][hardwareDevice].DeviceKind; got != DeviceKeyKindHardware {
+		t.Errorf("hardware device's DeviceKind after rotation is %v, want %v",
+			got, DeviceKeyKindHardware)
+	}
+}
+
+func TestRotateRejectsNonWriterCaller(t *testing.T) {
+	crypto := &rotateTestCrypto{signTestCrypto{signerKID: keybase1.KID("writer-device")}}
+	verifyingKey := VerifyingKey{KID: crypto.signerKID}
+	writer := keybase1.UID("alice")
+	mallory := keybase1.UID("mallory")
+
+	firstWriter := &TLFWriterKeyBundle{
+		WKeys: TLFKeyMap{writer: UserCryptKeyBundle{crypto.signerKID: TLFCryptKeyInfo{}}},
+	}
+	if err := firstWriter.sign(context.Background(), crypto); err != nil {
+		t.Fatalf("unexpected error signing: %v", err)
+	}
+	wGens := TLFWriterKeyGenerations{firstWriter}
+	rGens := TLFReaderKeyGenerations{&TLFReaderKeyBundle{RKeys: TLFKeyMap{}}}
+
+	_, _, _, _, err := Rotate(context.Background(), crypto, verifyingKey,
+		mallory, keybase1.KID("mallory-device"), wGens, rGens, TLFCryptKey{},
+		nil, nil, nil, nil, 2)
+	if _, ok := err.(NotATLFWriterError); !ok {
+		t.Fatalf("got error %v, want NotATLFWriterError", err)
+	}
+}
+
+func TestFillInDeviceInfoDefaultsWorkerCount(t *testing.T) {
+	devices := testCryptPublicKeys(4)
+	crypto := &fillInDeviceInfoTestCrypto{}
+
+	uckb := UserCryptKeyBundle{}
+	// numWorkers <= 0 should fall back to defaultKeyHalfWorkers rather
+	// than failing or processing devices serially.
+	_, err := uckb.fillInDeviceInfo(context.Background(), crypto,
+		keybase1.UID(""), TLFCryptKey{}, TLFEphemeralPrivateKey{}, 0, devices, nil, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(uckb) != len(devices) {
+		t.Fatalf("got %d bundle entries, want %d", len(uckb), len(devices))
+	}
+}
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// ClientCertAuth is an AuthMethod that authenticates to a git server
+// over mutual TLS by presenting a client X.509 certificate, for
+// servers that require mTLS instead of (or in addition to) HTTP
+// Basic/token auth.
+type ClientCertAuth struct {
+	// Certificate is the client certificate, with its private key,
+	// presented during the TLS handshake.
+	Certificate tls.Certificate
+	// RootCAs, if set, is used instead of the host's root CA set to
+	// verify the server's certificate.
+	RootCAs *x509.CertPool
+	// ServerName overrides the server name used both for SNI and to
+	// verify the server's certificate, for endpoints reached by an
+	// address that doesn't match the name on the certificate.
+	ServerName string
+
+	// CommonName, Organization, OrganizationalUnit, Locality,
+	// Province, Country and SerialNumber, when non-empty, constrain
+	// which server certificate Subject DN is accepted; a connection
+	// is rejected if the presented certificate's corresponding field
+	// doesn't match.
+	CommonName         string
+	Organization       string
+	OrganizationalUnit string
+	Locality           string
+	Province           string
+	Country            string
+	SerialNumber       string
+}
+
+// Name implements the AuthMethod interface.
+func (a *ClientCertAuth) Name() string {
+	return "client-cert-auth"
+}
+
+// String implements the AuthMethod interface.
+func (a *ClientCertAuth) String() string {
+	return a.Name() + " - " + a.ServerName
+}
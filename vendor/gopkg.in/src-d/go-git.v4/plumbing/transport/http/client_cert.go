@@ -0,0 +1,110 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// clientCertTLSConfig builds the *tls.Config a *transport.ClientCertAuth
+// describes: the client certificate to present, plus an optional
+// custom root pool, SNI/verification server name, and DN constraints
+// on the server's own certificate.
+func clientCertTLSConfig(auth *transport.ClientCertAuth) *tls.Config {
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{auth.Certificate},
+		RootCAs:      auth.RootCAs,
+		ServerName:   auth.ServerName,
+	}
+
+	if hasDNConstraints(auth) {
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyServerDN(auth, rawCerts)
+		}
+	}
+
+	return cfg
+}
+
+func hasDNConstraints(auth *transport.ClientCertAuth) bool {
+	return auth.CommonName != "" || auth.Organization != "" ||
+		auth.OrganizationalUnit != "" || auth.Locality != "" ||
+		auth.Province != "" || auth.Country != "" || auth.SerialNumber != ""
+}
+
+func verifyServerDN(auth *transport.ClientCertAuth, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("client-cert-auth: no server certificate presented")
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+
+	subject := cert.Subject
+	for _, check := range []struct {
+		want, have string
+		field      string
+	}{
+		{auth.CommonName, subject.CommonName, "CN"},
+		{auth.Organization, firstOrEmpty(subject.Organization), "O"},
+		{auth.OrganizationalUnit, firstOrEmpty(subject.OrganizationalUnit), "OU"},
+		{auth.Locality, firstOrEmpty(subject.Locality), "L"},
+		{auth.Province, firstOrEmpty(subject.Province), "ST"},
+		{auth.Country, firstOrEmpty(subject.Country), "C"},
+		{auth.SerialNumber, subject.SerialNumber, "SerialNumber"},
+	} {
+		if check.want != "" && check.want != check.have {
+			return fmt.Errorf(
+				"client-cert-auth: server certificate %s %q does not match required %q",
+				check.field, check.have, check.want)
+		}
+	}
+
+	return nil
+}
+
+func firstOrEmpty(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// applyClientCertAuth returns an *http.Client configured to present
+// auth's client certificate, when auth is a *transport.ClientCertAuth.
+// If c already carries a custom Transport (as session tests that
+// override session.client do), that client is returned unchanged so
+// the existing "caller-supplied client wins" behavior still takes
+// precedence over cert auth.
+//
+// newUploadPackSession (and newReceivePackSession, once this vendored
+// tree carries receive_pack.go) both route through here, so cert auth
+// applies to push as well as fetch.
+func applyClientCertAuth(c *http.Client, auth transport.AuthMethod) *http.Client {
+	certAuth, ok := auth.(*transport.ClientCertAuth)
+	if !ok || certAuth == nil {
+		return c
+	}
+
+	if c != nil && c.Transport != nil {
+		return c
+	}
+
+	client := &http.Client{}
+	if c != nil {
+		*client = *c
+	}
+
+	// Start from a clone of http.DefaultTransport rather than a zero
+	// value, so defaults like Proxy: http.ProxyFromEnvironment survive;
+	// only TLSClientConfig is overridden.
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = clientCertTLSConfig(certAuth)
+	client.Transport = tr
+	return client
+}
@@ -0,0 +1,107 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+func TestVerifyServerDNRejectsMismatchedCommonName(t *testing.T) {
+	auth := &transport.ClientCertAuth{CommonName: "git.example.com"}
+	rawCerts := [][]byte{makeTestCert(t, "evil.example.com")}
+
+	if err := verifyServerDN(auth, rawCerts); err == nil {
+		t.Fatal("expected verifyServerDN to reject a mismatched CommonName")
+	}
+}
+
+func TestVerifyServerDNAcceptsMatchingCommonName(t *testing.T) {
+	auth := &transport.ClientCertAuth{CommonName: "git.example.com"}
+	rawCerts := [][]byte{makeTestCert(t, "git.example.com")}
+
+	if err := verifyServerDN(auth, rawCerts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestVerifyServerDNNoCertificates(t *testing.T) {
+	auth := &transport.ClientCertAuth{CommonName: "git.example.com"}
+
+	if err := verifyServerDN(auth, nil); err == nil {
+		t.Fatal("expected an error when the server presents no certificate")
+	}
+}
+
+func TestHasDNConstraints(t *testing.T) {
+	if hasDNConstraints(&transport.ClientCertAuth{}) {
+		t.Error("empty ClientCertAuth should have no DN constraints")
+	}
+	if !hasDNConstraints(&transport.ClientCertAuth{CommonName: "git.example.com"}) {
+		t.Error("a ClientCertAuth with a CommonName should have DN constraints")
+	}
+}
+
+func TestApplyClientCertAuthNonCertAuth(t *testing.T) {
+	c := &http.Client{}
+	got := applyClientCertAuth(c, nil)
+	if got != c {
+		t.Error("applyClientCertAuth should return the original client unchanged for non-cert auth")
+	}
+}
+
+func TestApplyClientCertAuthDefersToCallerTransport(t *testing.T) {
+	callerTransport := &http.Transport{}
+	c := &http.Client{Transport: callerTransport}
+	auth := &transport.ClientCertAuth{CommonName: "git.example.com"}
+
+	got := applyClientCertAuth(c, auth)
+	if got != c || got.Transport != callerTransport {
+		t.Error("applyClientCertAuth should not override a caller-supplied Transport")
+	}
+}
+
+func TestApplyClientCertAuthConfiguresTLS(t *testing.T) {
+	auth := &transport.ClientCertAuth{CommonName: "git.example.com"}
+
+	got := applyClientCertAuth(&http.Client{}, auth)
+	tr, ok := got.Transport.(*http.Transport)
+	if !ok || tr.TLSClientConfig == nil {
+		t.Fatal("expected applyClientCertAuth to set an *http.Transport with a TLS config")
+	}
+	if tr.TLSClientConfig.VerifyPeerCertificate == nil {
+		t.Error("expected VerifyPeerCertificate to be set when DN constraints are present")
+	}
+	if tr.Proxy == nil {
+		t.Error("expected applyClientCertAuth to preserve http.DefaultTransport's Proxy, not build a zero-value Transport")
+	}
+}
+
+// makeTestCert builds a minimal self-signed certificate for the given
+// common name and returns its DER bytes, so verifyServerDN tests don't
+// need a full PKI fixture on disk.
+func makeTestCert(t *testing.T, commonName string) []byte {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create test certificate: %v", err)
+	}
+	return der
+}
@@ -19,7 +19,7 @@ type upSession struct {
 }
 
 func newUploadPackSession(c *http.Client, ep transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
-	s, err := newSession(c, ep, auth)
+	s, err := newSession(applyClientCertAuth(c, auth), ep, auth)
 
 	return &upSession{s}, err
 }